@@ -34,6 +34,7 @@ import (
 // RunnerList implements a reloadable.List of Runners
 type RunnerList struct {
 	runners  map[uint64]Runner
+	configs  map[uint64]*common.Config
 	mutex    sync.RWMutex
 	factory  RunnerFactory
 	pipeline beat.PipelineConnector
@@ -44,6 +45,7 @@ type RunnerList struct {
 func NewRunnerList(name string, factory RunnerFactory, pipeline beat.PipelineConnector) *RunnerList {
 	return &RunnerList{
 		runners:  map[uint64]Runner{},
+		configs:  map[uint64]*common.Config{},
 		factory:  factory,
 		pipeline: pipeline,
 		logger:   logp.NewLogger(name),
@@ -84,6 +86,7 @@ func (r *RunnerList) Reload(configs []*reload.ConfigWithMeta) error {
 	for hash, runner := range stopList {
 		r.logger.Debugf("Stopping runner: %s", runner)
 		delete(r.runners, hash)
+		delete(r.configs, hash)
 		go runner.Stop()
 		moduleStops.Add(1)
 	}
@@ -104,6 +107,7 @@ func (r *RunnerList) Reload(configs []*reload.ConfigWithMeta) error {
 
 		r.logger.Debugf("Starting runner: %s", runner)
 		r.runners[hash] = runner
+		r.configs[hash] = config.Config
 		runner.Start()
 		moduleStarts.Add(1)
 	}
@@ -133,6 +137,7 @@ func (r *RunnerList) Stop() {
 		wg.Add(1)
 
 		delete(r.runners, hash)
+		delete(r.configs, hash)
 
 		// Stop modules in parallel
 		go func(h uint64, run Runner) {
@@ -154,6 +159,18 @@ func (r *RunnerList) Has(hash uint64) bool {
 	return ok
 }
 
+// Configs returns the configs of the runners in the list, indexed by hash
+func (r *RunnerList) Configs() map[uint64]*common.Config {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	configs := make(map[uint64]*common.Config, len(r.configs))
+	for hash, config := range r.configs {
+		configs[hash] = config
+	}
+	return configs
+}
+
 // HashConfig hashes a given common.Config
 func HashConfig(c *common.Config) (uint64, error) {
 	var config map[string]interface{}
@@ -231,6 +231,29 @@ func TestHas(t *testing.T) {
 	assert.False(t, list.Has(0))
 }
 
+func TestConfigs(t *testing.T) {
+	factory := &runnerFactory{}
+	list := NewRunnerList("", factory, nil)
+	config := createConfig(1)
+
+	hash, err := HashConfig(config.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, list.Configs())
+
+	list.Reload([]*reload.ConfigWithMeta{
+		config,
+	})
+
+	assert.Equal(t, map[uint64]*common.Config{hash: config.Config}, list.Configs())
+
+	list.Reload([]*reload.ConfigWithMeta{})
+
+	assert.Empty(t, list.Configs())
+}
+
 func TestCreateRunnerAddsDynamicMeta(t *testing.T) {
 	newMapStrPointer := func(m common.MapStr) *common.MapStrPointer {
 		p := common.NewMapStrPointer(m)
@@ -78,7 +78,8 @@ type Manager interface {
 	// so the beat can be told when to stop.
 	Start(stopFunc func())
 
-	// Stop the config manager.
+	// Stop the config manager. The beat defers Stop, so a manager can recover
+	// a panic stopping the beat to report it before panicking again.
 	Stop()
 
 	// CheckRawConfig check settings are correct before launching the beat.
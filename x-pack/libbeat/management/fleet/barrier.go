@@ -0,0 +1,18 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"context"
+)
+
+// ReloadBarrier coordinates reloads between multiple managed beats, so peers
+// can apply a new configuration together.
+type ReloadBarrier interface {
+	// Wait is called before a new configuration is applied and blocks until
+	// the peers are ready to reload. The configuration is not applied when an
+	// error is returned. The context is cancelled when the manager stops.
+	Wait(ctx context.Context) error
+}
@@ -5,19 +5,98 @@
 package fleet
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	xmanagement "github.com/elastic/beats/v7/x-pack/libbeat/management"
 )
 
+const (
+	// NoOutputWait holds the inputs until an output is received.
+	NoOutputWait = "wait"
+
+	// NoOutputLocal starts the inputs using the output already configured in
+	// the beat. Inputs wait for an output when the beat has none.
+	NoOutputLocal = "local"
+
+	// NoOutputInvalid reports a configuration with inputs but no output as invalid.
+	NoOutputInvalid = "invalid"
+)
+
+const (
+	// MissingPathsIgnore doesn't check the paths referenced by the inputs.
+	MissingPathsIgnore = "ignore"
+
+	// MissingPathsDegraded reports inputs referencing paths that don't exist
+	// yet as degraded while the inputs keep running.
+	MissingPathsDegraded = "degraded"
+)
+
 // Config for central management
 type Config struct {
 	Enabled   bool                                `config:"enabled" yaml:"enabled"`
 	Mode      string                              `config:"mode" yaml:"mode"`
 	Blacklist xmanagement.ConfigBlacklistSettings `config:"blacklist" yaml:"blacklist"`
+
+	// FlapSuppression is the duration a failure must persist before it is
+	// reported as failed. Until then the failure is reported as degraded.
+	// Only failures reported by the beat through UpdateStatus are suppressed,
+	// failures applying the configuration are always reported as failed.
+	// Disabled when zero.
+	FlapSuppression time.Duration `config:"flap_suppression" yaml:"flap_suppression"`
+
+	// NoOutput is the behavior when Agent sends inputs without an output.
+	// Options: [wait, local, invalid]
+	NoOutput string `config:"no_output" yaml:"no_output"`
+
+	// ReconcilePeriod is how often the units running in the beat are compared
+	// with the units expected by Agent. Disabled when zero.
+	ReconcilePeriod time.Duration `config:"reconcile_period" yaml:"reconcile_period"`
+
+	// MissingPaths is the behavior when inputs reference paths that don't
+	// exist. Options: [ignore, degraded]
+	MissingPaths string `config:"missing_paths" yaml:"missing_paths"`
+
+	// MissingPathsPeriod is how often missing paths are checked again.
+	MissingPathsPeriod time.Duration `config:"missing_paths_period" yaml:"missing_paths_period"`
+
+	// ShutdownTimeout is the duration the beat has to stop after Agent
+	// requested it, before the shutdown is reported as ungraceful. Disabled
+	// when zero.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" yaml:"shutdown_timeout"`
+
+	// ReloadBarrierTimeout is the duration a new configuration waits on the
+	// reload barrier before it is reported as failed. Disabled when zero.
+	ReloadBarrierTimeout time.Duration `config:"reload_barrier_timeout" yaml:"reload_barrier_timeout"`
+}
+
+// Validate validates the fleet management settings.
+func (c *Config) Validate() error {
+	supported := []string{NoOutputWait, NoOutputLocal, NoOutputInvalid}
+	if !anyOf(supported, c.NoOutput) {
+		return fmt.Errorf("not supported no_output %v, expected one of %s", c.NoOutput, strings.Join(supported, ", "))
+	}
+
+	supported = []string{MissingPathsIgnore, MissingPathsDegraded}
+	if !anyOf(supported, c.MissingPaths) {
+		return fmt.Errorf("not supported missing_paths %v, expected one of %s", c.MissingPaths, strings.Join(supported, ", "))
+	}
+	if c.MissingPaths == MissingPathsDegraded && c.MissingPathsPeriod <= 0 {
+		return fmt.Errorf("missing_paths_period must be positive when missing_paths is %v", MissingPathsDegraded)
+	}
+	return nil
 }
 
 func defaultConfig() *Config {
 	return &Config{
-		Mode: xmanagement.ModeCentralManagement,
+		Mode:                 xmanagement.ModeCentralManagement,
+		NoOutput:             NoOutputWait,
+		ReconcilePeriod:      60 * time.Second,
+		MissingPaths:         MissingPathsIgnore,
+		MissingPathsPeriod:   10 * time.Second,
+		ShutdownTimeout:      30 * time.Second,
+		ReloadBarrierTimeout: 30 * time.Second,
 		Blacklist: xmanagement.ConfigBlacklistSettings{
 			Patterns: map[string]string{
 				"output": "console|file",
@@ -25,3 +104,12 @@ func defaultConfig() *Config {
 		},
 	}
 }
+
+func anyOf(elems []string, s string) bool {
+	for _, elem := range elems {
+		if s == elem {
+			return true
+		}
+	}
+	return false
+}
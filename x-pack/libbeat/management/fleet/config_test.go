@@ -0,0 +1,54 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestConfigNoOutput(t *testing.T) {
+	c := defaultConfig()
+	assert.Equal(t, NoOutputWait, c.NoOutput)
+
+	cfg := common.MustNewConfigFrom(map[string]interface{}{"no_output": "local"})
+	assert.NoError(t, cfg.Unpack(c))
+	assert.Equal(t, NoOutputLocal, c.NoOutput)
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{"no_output": "drop"})
+	assert.Error(t, cfg.Unpack(c))
+}
+
+func TestConfigMissingPaths(t *testing.T) {
+	c := defaultConfig()
+	assert.Equal(t, MissingPathsIgnore, c.MissingPaths)
+
+	cfg := common.MustNewConfigFrom(map[string]interface{}{"missing_paths": "degraded"})
+	assert.NoError(t, cfg.Unpack(c))
+	assert.Equal(t, MissingPathsDegraded, c.MissingPaths)
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{"missing_paths": "retry"})
+	assert.Error(t, cfg.Unpack(c))
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{"missing_paths": "degraded", "missing_paths_period": 0})
+	assert.Error(t, cfg.Unpack(defaultConfig()))
+}
+
+func TestPluginInvalidFleetSettings(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"enabled":   true,
+		"mode":      "x-pack-fleet",
+		"no_output": "drop",
+	})
+	factory := NewFleetManagerPlugin(cfg)
+	if assert.NotNil(t, factory) {
+		_, err := factory(cfg, nil, uuid.Nil)
+		assert.Error(t, err)
+	}
+}
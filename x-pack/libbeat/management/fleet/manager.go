@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
@@ -27,6 +29,13 @@ import (
 	xmanagement "github.com/elastic/beats/v7/x-pack/libbeat/management"
 )
 
+// outputType is the config block type holding the output configuration.
+const outputType = "output"
+
+// finalStatusDelay is how long the manager waits for the final status to be
+// sent before stopping the client, which checks in every 500ms.
+const finalStatusDelay = time.Second
+
 // Manager handles internal config updates. By retrieving
 // new configs from Kibana and applying them to the Beat.
 type Manager struct {
@@ -40,10 +49,71 @@ type Manager struct {
 	status    management.Status
 	msg       string
 	payload   map[string]interface{}
-
+	metrics   *configMetrics
+	barrier   ReloadBarrier
+
+	// outputConfigured is true when the output reloadable has a config, from
+	// the local beat settings or from Agent.
+	outputConfigured bool
+
+	// expected are the units of the last configuration applied, indexed by
+	// config type and config hash, generation is incremented each time they
+	// change. mismatch holds the difference with the running units while the
+	// beat is reported degraded because of it.
+	expected       map[string]map[uint64]string
+	generation     uint64
+	mismatch       map[string]unitMismatch
+	reconcileTimer timer
+
+	// inputs are the applied blocks checked for missing paths, missingPaths
+	// holds the paths they wait on while the beat is reported degraded
+	// because of them.
+	inputs            api.ConfigBlocks
+	missingPaths      map[string][]string
+	missingPathsTimer timer
+
+	// failedSince is the time the beat started reporting a failure, zero
+	// when the beat is not failing.
+	failedSince time.Time
+	failedTimer timer
+	clock       clock
+
+	// started is true once the client is started.
+	started bool
+
+	// stopRequested is the time Agent requested the beat to stop,
+	// shutdownErr describes why the shutdown was not graceful, stopped is
+	// true once the final state is reported.
+	stopRequested time.Time
+	shutdownErr   string
+	shutdownTimer timer
+	stopped       bool
+
+	ctx      context.Context
+	cancel   context.CancelFunc
 	stopFunc func()
 }
 
+// clock is an interface used to provide mocked time on testing
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a timer created by a clock
+type timer interface {
+	Stop() bool
+}
+
+// systemClock implements the clock interface using the system clock via the time package
+type systemClock struct{}
+
+// Now returns the current time
+func (*systemClock) Now() time.Time { return time.Now() }
+
+// AfterFunc calls f in its own goroutine after the duration elapses
+func (*systemClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
 // NewFleetManager returns a X-Pack Beats Fleet Management manager.
 func NewFleetManager(config *common.Config, registry *reload.Registry, beatUUID uuid.UUID) (management.Manager, error) {
 	c := defaultConfig()
@@ -64,7 +134,10 @@ func NewFleetManagerWithConfig(c *Config, registry *reload.Registry, beatUUID uu
 		logger:   log.Named("fleet"),
 		beatUUID: beatUUID,
 		registry: registry,
+		metrics:  &configMetrics{},
+		clock:    &systemClock{},
 	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
 
 	var err error
 	var blacklist *xmanagement.ConfigBlacklist
@@ -81,6 +154,8 @@ func NewFleetManagerWithConfig(c *Config, registry *reload.Registry, beatUUID uu
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create elastic-agent-client")
 		}
+
+		m.metrics.register()
 	}
 
 	m.blacklist = blacklist
@@ -93,6 +168,19 @@ func (cm *Manager) Enabled() bool {
 	return cm.config.Enabled && cm.config.Mode == xmanagement.ModeFleet
 }
 
+// Config returns a copy of the effective fleet management settings. The fleet
+// management settings hold no credentials, so nothing needs to be redacted.
+func (cm *Manager) Config() Config {
+	c := *cm.config
+	if c.Blacklist.Patterns != nil {
+		c.Blacklist.Patterns = make(map[string]string, len(cm.config.Blacklist.Patterns))
+		for k, v := range cm.config.Blacklist.Patterns {
+			c.Blacklist.Patterns[k] = v
+		}
+	}
+	return c
+}
+
 // Start the config manager
 func (cm *Manager) Start(stopFunc func()) {
 	if !cm.Enabled() {
@@ -106,17 +194,54 @@ func (cm *Manager) Start(stopFunc func()) {
 	err := cm.client.Start(context.Background())
 	if err != nil {
 		cm.logger.Errorf("failed to start elastic-agent-client: %s", err)
+	} else {
+		cm.lock.Lock()
+		cm.started = true
+		cm.lock.Unlock()
+	}
+
+	if cm.config.ReconcilePeriod > 0 {
+		cm.scheduleReconcile(cm.config.ReconcilePeriod)
+	}
+	if cm.config.MissingPaths == MissingPathsDegraded {
+		cm.scheduleMissingPaths(cm.config.MissingPathsPeriod)
 	}
 }
 
-// Stop the config manager
+// Stop the config manager. Stop is deferred by the beat, a panic stopping
+// the beat is reported to Agent before panicking again.
 func (cm *Manager) Stop() {
 	if !cm.Enabled() {
 		return
 	}
 
+	r := recover()
+
 	cm.logger.Info("Stopping fleet management service")
+	cm.cancel()
+
+	cm.lock.Lock()
+	cm.resetFailed()
+	if cm.reconcileTimer != nil {
+		cm.reconcileTimer.Stop()
+		cm.reconcileTimer = nil
+	}
+	if cm.missingPathsTimer != nil {
+		cm.missingPathsTimer.Stop()
+		cm.missingPathsTimer = nil
+	}
+	if r != nil {
+		cm.setShutdownErr(fmt.Sprintf("panic: %v", r))
+	}
+	cm.lock.Unlock()
+
+	cm.reportStopped()
+	cm.flushStatus()
 	cm.client.Stop()
+
+	if r != nil {
+		panic(r)
+	}
 }
 
 // CheckRawConfig check settings are correct to start the beat. This method
@@ -124,14 +249,48 @@ func (cm *Manager) Stop() {
 // fleet management can configure.
 func (cm *Manager) CheckRawConfig(cfg *common.Config) error {
 	// TODO implement this method
+
+	// Record whether the beat starts with a local output, used when Agent
+	// sends inputs without an output.
+	var local struct {
+		Output common.ConfigNamespace `config:"output"`
+	}
+	if err := cfg.Unpack(&local); err == nil && local.Output.IsSet() && local.Output.Config().Enabled() {
+		cm.lock.Lock()
+		cm.outputConfigured = true
+		cm.lock.Unlock()
+	}
 	return nil
 }
 
 // UpdateStatus updates the manager with the current status for the beat.
 func (cm *Manager) UpdateStatus(status management.Status, msg string) {
+	cm.updateStatus(status, msg, true)
+}
+
+// configFailed reports a failure to apply the configuration. These failures
+// are not transient, so they are never suppressed.
+func (cm *Manager) configFailed(msg string) {
+	cm.updateStatus(management.Failed, msg, false)
+}
+
+func (cm *Manager) updateStatus(status management.Status, msg string, suppress bool) {
 	cm.lock.Lock()
 	defer cm.lock.Unlock()
 
+	cm.mismatch = nil
+	cm.missingPaths = nil
+	if status == management.Failed && suppress {
+		status = cm.suppressFailed()
+	} else {
+		cm.resetFailed()
+	}
+	cm.setStatus(status, msg)
+}
+
+// setStatus reports the status to the Elastic Agent if it changed. It must be
+// called with the lock held.
+func (cm *Manager) setStatus(status management.Status, msg string) {
 	if cm.status != status || cm.msg != msg {
 		cm.status = status
 		cm.msg = msg
@@ -140,6 +299,88 @@ func (cm *Manager) UpdateStatus(status management.Status, msg string) {
 	}
 }
 
+// reportDegraded reports the beat as degraded while inputs wait on missing
+// paths or the running units don't match the units expected by Agent, and as
+// running again once neither holds. It must be called with the lock held.
+func (cm *Manager) reportDegraded() {
+	var msgs []string
+	payload := map[string]interface{}{}
+	for k, v := range cm.payload {
+		payload[k] = v
+	}
+	if len(cm.missingPaths) > 0 {
+		msgs = append(msgs, missingPathsMessage(cm.missingPaths))
+		payload["missing_paths"] = cm.missingPaths
+	}
+	if len(cm.mismatch) > 0 {
+		msgs = append(msgs, mismatchMessage(cm.mismatch))
+		payload["units_mismatch"] = cm.mismatch
+	}
+
+	if len(msgs) == 0 {
+		if cm.status == management.Degraded {
+			cm.status = management.Running
+			cm.msg = "Running"
+			cm.client.Status(proto.StateObserved_HEALTHY, cm.msg, cm.payload)
+		}
+		return
+	}
+
+	msg := strings.Join(msgs, "; ")
+	if cm.status == management.Degraded && cm.msg == msg {
+		return
+	}
+
+	cm.logger.Warn(msg)
+	cm.status = management.Degraded
+	cm.msg = msg
+	cm.client.Status(proto.StateObserved_DEGRADED, msg, payload)
+}
+
+// suppressFailed returns the status to report for a failure. When flap
+// suppression is enabled a failure is reported as degraded until it has
+// persisted for the configured duration. It must be called with the lock held.
+func (cm *Manager) suppressFailed() management.Status {
+	threshold := cm.config.FlapSuppression
+	if threshold <= 0 {
+		return management.Failed
+	}
+
+	now := cm.clock.Now()
+	if cm.failedSince.IsZero() {
+		cm.failedSince = now
+		cm.failedTimer = cm.clock.AfterFunc(threshold, cm.checkFailed)
+	}
+	if now.Sub(cm.failedSince) < threshold {
+		return management.Degraded
+	}
+	return management.Failed
+}
+
+// resetFailed clears the failure tracking used by flap suppression. It must be
+// called with the lock held.
+func (cm *Manager) resetFailed() {
+	cm.failedSince = time.Time{}
+	if cm.failedTimer != nil {
+		cm.failedTimer.Stop()
+		cm.failedTimer = nil
+	}
+}
+
+// checkFailed reports a suppressed failure as failed once it has persisted
+// for the configured flap suppression duration.
+func (cm *Manager) checkFailed() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.failedSince.IsZero() || cm.status != management.Degraded || !cm.stopRequested.IsZero() {
+		return
+	}
+	if cm.clock.Now().Sub(cm.failedSince) >= cm.config.FlapSuppression {
+		cm.setStatus(management.Failed, cm.msg)
+	}
+}
+
 func (cm *Manager) OnConfig(s string) {
 	cm.UpdateStatus(management.Configuring, "Updating configuration")
 
@@ -148,7 +389,7 @@ func (cm *Manager) OnConfig(s string) {
 	if err != nil {
 		err = errors.Wrap(err, "config blocks unsuccessfully generated")
 		cm.logger.Error(err)
-		cm.UpdateStatus(management.Failed, err.Error())
+		cm.configFailed(err.Error())
 		return
 	}
 
@@ -156,7 +397,7 @@ func (cm *Manager) OnConfig(s string) {
 	if err != nil {
 		err = errors.Wrap(err, "config blocks unsuccessfully generated")
 		cm.logger.Error(err)
-		cm.UpdateStatus(management.Failed, err.Error())
+		cm.configFailed(err.Error())
 		return
 	}
 
@@ -164,17 +405,113 @@ func (cm *Manager) OnConfig(s string) {
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse configuration")
 		cm.logger.Error(err)
-		cm.UpdateStatus(management.Failed, err.Error())
+		cm.configFailed(err.Error())
 		return
 	}
 
-	if errs := cm.apply(blocks); !errs.IsEmpty() {
+	msg := "Running"
+	waiting := false
+	keepOutput := false
+	if !hasOutput(blocks) && hasInputs(blocks) {
+		switch cm.config.NoOutput {
+		case NoOutputInvalid:
+			err := errors.New("configuration has inputs but no output")
+			cm.logger.Error(err)
+			cm.configFailed(err.Error())
+			return
+		case NoOutputLocal:
+			if cm.hasOutputConfigured() {
+				cm.logger.Warn("No output received, starting inputs with the local output")
+				msg = "Running with local output, no output received"
+				keepOutput = true
+				break
+			}
+			cm.logger.Warn("No output received and no local output configured, inputs are waiting for an output")
+			blocks = api.ConfigBlocks{}
+			waiting = true
+		default:
+			cm.logger.Warn("No output received, inputs are waiting for an output")
+			// unset all the inputs until a config with an output is received
+			blocks = api.ConfigBlocks{}
+			waiting = true
+		}
+	}
+
+	if err := cm.waitBarrier(); err != nil {
+		err = errors.Wrap(err, "reload barrier failed")
+		cm.logger.Error(err)
+		cm.configFailed(err.Error())
+		return
+	}
+
+	cm.setExpected(blocks)
+	if errs := cm.apply(blocks, keepOutput); !errs.IsEmpty() {
 		// `cm.apply` already logs the errors; currently allow beat to run degraded
-		cm.UpdateStatus(management.Failed, errs.Error())
+		cm.configFailed(errs.Error())
+		return
+	}
+
+	cm.metrics.update(blocks, cm.registry)
+
+	if waiting {
+		cm.UpdateStatus(management.Degraded, "Inputs are waiting for an output, no output received")
 		return
 	}
 
-	cm.client.Status(proto.StateObserved_HEALTHY, "Running", cm.payload)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.resetFailed()
+	cm.mismatch = nil
+	cm.missingPaths = nil
+	cm.status = management.Running
+	cm.msg = msg
+	if cm.config.MissingPaths == MissingPathsDegraded {
+		cm.inputs = blocks
+		if cm.missingPaths = findMissingPaths(blocks); len(cm.missingPaths) > 0 {
+			cm.reportDegraded()
+			return
+		}
+	}
+	cm.client.Status(proto.StateObserved_HEALTHY, msg, cm.payload)
+}
+
+// hasOutputConfigured returns true if the output reloadable has a config.
+func (cm *Manager) hasOutputConfigured() bool {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	return cm.outputConfigured
+}
+
+// SetReloadBarrier sets the barrier consulted before applying a new
+// configuration. A nil barrier applies configurations as soon as they are
+// received.
+func (cm *Manager) SetReloadBarrier(barrier ReloadBarrier) {
+	cm.lock.Lock()
+	cm.barrier = barrier
+	cm.lock.Unlock()
+}
+
+// waitBarrier waits on the reload barrier, if any, for at most
+// ReloadBarrierTimeout.
+func (cm *Manager) waitBarrier() error {
+	cm.lock.Lock()
+	barrier := cm.barrier
+	cm.lock.Unlock()
+
+	if barrier == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(cm.ctx)
+	if timeout := cm.config.ReloadBarrierTimeout; timeout > 0 {
+		ctx, cancel = context.WithTimeout(cm.ctx, timeout)
+	}
+	defer cancel()
+
+	cm.logger.Debug("Waiting on reload barrier")
+	return barrier.Wait(ctx)
 }
 
 func (cm *Manager) RegisterAction(action client.Action) {
@@ -191,22 +528,119 @@ func (cm *Manager) SetPayload(payload map[string]interface{}) {
 	cm.lock.Unlock()
 }
 
+// OnStop stops the beat when Agent requests it. The client only calls it once,
+// it ignores the expected states received once the beat is stopping.
 func (cm *Manager) OnStop() {
 	if cm.stopFunc != nil {
-		cm.client.Status(proto.StateObserved_STOPPING, "Stopping", nil)
+		cm.lock.Lock()
+		cm.stopRequested = cm.clock.Now()
+		cm.resetFailed()
+		if timeout := cm.config.ShutdownTimeout; timeout > 0 {
+			cm.shutdownTimer = cm.clock.AfterFunc(timeout, cm.shutdownTimedOut)
+		}
+		cm.setStatus(management.Stopping, "Stopping")
+		cm.lock.Unlock()
+
+		defer func() {
+			if r := recover(); r != nil {
+				// the panic crashes the beat from the client goroutine, Stop
+				// won't run, so the final state is reported here
+				cm.lock.Lock()
+				cm.setShutdownErr(fmt.Sprintf("panic during shutdown: %v", r))
+				cm.reportShutdown("Stopping")
+				cm.lock.Unlock()
+				cm.flushStatus()
+				panic(r)
+			}
+		}()
 		cm.stopFunc()
 	}
 }
 
+// shutdownTimedOut reports the shutdown as ungraceful when the beat didn't
+// stop within the shutdown timeout.
+func (cm *Manager) shutdownTimedOut() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.stopped {
+		return
+	}
+	cm.setShutdownErr(fmt.Sprintf("shutdown timeout of %v exceeded", cm.config.ShutdownTimeout))
+	cm.reportShutdown("Stopping")
+}
+
+// setShutdownErr records why the shutdown is not graceful, keeping the first
+// reason. It must be called with the lock held.
+func (cm *Manager) setShutdownErr(reason string) {
+	if cm.shutdownErr == "" {
+		cm.shutdownErr = reason
+	}
+}
+
+// reportStopped reports the final state to Agent, telling whether the beat
+// shut down gracefully.
+func (cm *Manager) reportStopped() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.shutdownTimer != nil {
+		cm.shutdownTimer.Stop()
+		cm.shutdownTimer = nil
+	}
+	cm.stopped = true
+	cm.reportShutdown("Stopped")
+}
+
+// reportShutdown reports the shutdown outcome to Agent. It must be called with
+// the lock held.
+func (cm *Manager) reportShutdown(msg string) {
+	shutdown := map[string]interface{}{"graceful": true}
+	if cm.shutdownErr != "" {
+		msg = fmt.Sprintf("%s ungracefully: %s", msg, cm.shutdownErr)
+		shutdown = map[string]interface{}{"graceful": false, "reason": cm.shutdownErr}
+		cm.logger.Warn(msg)
+	}
+
+	payload := map[string]interface{}{}
+	for k, v := range cm.payload {
+		payload[k] = v
+	}
+	payload["shutdown"] = shutdown
+
+	cm.status = management.Stopping
+	cm.msg = msg
+	cm.client.Status(proto.StateObserved_STOPPING, msg, payload)
+}
+
+// flushStatus waits for the client to send the last reported status to Agent.
+// The client only stores the status, it is sent on the next check-in. There is
+// nothing to wait for if the client never started.
+func (cm *Manager) flushStatus() {
+	cm.lock.Lock()
+	started := cm.started
+	cm.lock.Unlock()
+	if !started {
+		return
+	}
+
+	done := make(chan struct{})
+	cm.clock.AfterFunc(finalStatusDelay, func() { close(done) })
+	<-done
+}
+
 func (cm *Manager) OnError(err error) {
 	cm.logger.Errorf("elastic-agent-client got error: %s", err)
 }
 
-func (cm *Manager) apply(blocks api.ConfigBlocks) xmanagement.Errors {
+// apply reloads the given config blocks and unsets the registered configs
+// that are missing from them. When keepOutput is true a missing output is left
+// untouched.
+func (cm *Manager) apply(blocks api.ConfigBlocks, keepOutput bool) xmanagement.Errors {
 	var errors xmanagement.Errors
 	missing := map[string]bool{}
 	for _, name := range cm.registry.GetRegisteredNames() {
-		missing[name] = true
+		missing[name] = !(keepOutput && name == outputType)
 	}
 
 	// Detect unwanted configs from the list
@@ -259,6 +693,12 @@ func (cm *Manager) reload(t string, blocks []*api.ConfigBlock) *xmanagement.Erro
 			cm.logger.Error(err)
 			return xmanagement.NewConfigError(err)
 		}
+
+		if t == outputType {
+			cm.lock.Lock()
+			cm.outputConfigured = config != nil
+			cm.lock.Unlock()
+		}
 	} else if obj := cm.registry.GetReloadableList(t); obj != nil {
 		// List
 		var configs []*reload.ConfigWithMeta
@@ -317,6 +757,27 @@ func (cm *Manager) toConfigBlocks(cfg common.MapStr) (api.ConfigBlocks, error) {
 	return res, nil
 }
 
+// hasOutput returns true if the blocks include an output configuration.
+func hasOutput(blocks api.ConfigBlocks) bool {
+	for _, b := range blocks {
+		if b.Type == outputType && len(b.Blocks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInputs returns true if the blocks include any configuration other than
+// the output.
+func hasInputs(blocks api.ConfigBlocks) bool {
+	for _, b := range blocks {
+		if b.Type != outputType && len(b.Blocks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func statusToProtoStatus(status management.Status) proto.StateObserved_Status {
 	switch status {
 	case management.Unknown:
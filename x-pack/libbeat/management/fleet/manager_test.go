@@ -5,15 +5,30 @@
 package fleet
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
 	"github.com/elastic/elastic-agent-client/v7/pkg/proto"
 
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/common/reload"
+	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/management"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+
+	xmanagement "github.com/elastic/beats/v7/x-pack/libbeat/management"
 )
 
 func TestConfigBlocks(t *testing.T) {
@@ -67,8 +82,882 @@ func TestStatusToProtoStatus(t *testing.T) {
 	assert.Equal(t, proto.StateObserved_STOPPING, statusToProtoStatus(management.Stopping))
 }
 
+func TestFlapSuppression(t *testing.T) {
+	t.Run("disabled reports failed immediately", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+	})
+
+	t.Run("reports degraded until the failure persists", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{FlapSuppression: time.Hour})
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+
+		clock.Sleep(30 * time.Minute)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+
+		clock.Sleep(30 * time.Minute)
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+		assert.Equal(t, "connection refused", c.lastMessage())
+	})
+
+	t.Run("recovery clears the failure", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{FlapSuppression: time.Hour})
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		clock.Sleep(30 * time.Minute)
+		cm.UpdateStatus(management.Running, "Running")
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		clock.Sleep(30 * time.Minute)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, 1, clock.pending())
+	})
+
+	t.Run("config errors are not suppressed", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{FlapSuppression: time.Hour})
+
+		cm.OnConfig("invalid: [")
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+		assert.Equal(t, 0, clock.pending())
+	})
+
+	t.Run("stop request cancels the failure timer", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{FlapSuppression: time.Hour})
+		cm.stopFunc = func() {}
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		cm.OnStop()
+		assert.Equal(t, 0, clock.pending())
+
+		clock.Sleep(2 * time.Hour)
+		assert.Equal(t, proto.StateObserved_STOPPING, c.lastStatus())
+	})
+
+	t.Run("stop cancels the failure timer", func(t *testing.T) {
+		cm, _, clock := newTestManager(&Config{Enabled: true, Mode: xmanagement.ModeFleet, FlapSuppression: time.Hour})
+
+		cm.UpdateStatus(management.Failed, "connection refused")
+		assert.Equal(t, 1, clock.pending())
+
+		stopManager(t, cm, clock)
+		assert.Equal(t, 0, clock.pending())
+	})
+}
+
+func TestConfigMetrics(t *testing.T) {
+	input := `
+filebeat:
+  inputs:
+    - type: log
+      id: hello1
+      paths:
+        - /var/log/hello1.log
+      processors:
+        - add_fields:
+            fields:
+              hello: world
+        - drop_fields:
+            fields: ["agent"]
+    - type: log
+      paths:
+        - /var/log/hello2.log
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`
+
+	cm, c, _ := newTestManager(&Config{})
+	cm.OnConfig(input)
+	assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+	reg := monitoring.NewRegistry()
+	monitoring.NewFunc(reg, "config", cm.metrics.report, monitoring.Report)
+	snapshot := monitoring.CollectFlatSnapshot(reg, monitoring.Full, false)
+
+	assert.Equal(t,
+		snapshot.Ints["config.types.filebeat.inputs.bytes"]+snapshot.Ints["config.types.output.bytes"],
+		snapshot.Ints["config.bytes"])
+	assert.Equal(t, int64(2), snapshot.Ints["config.inputs"])
+	assert.Equal(t, int64(2), snapshot.Ints["config.processors"])
+	assert.Equal(t, int64(2), snapshot.Ints["config.types.filebeat.inputs.inputs"])
+	assert.Equal(t, int64(2), snapshot.Ints["config.types.filebeat.inputs.processors"])
+	assert.Equal(t, int64(0), snapshot.Ints["config.types.output.inputs"])
+	assert.NotZero(t, snapshot.Ints["config.types.output.bytes"])
+
+	assert.Equal(t, "filebeat.inputs", snapshot.Strings["config.units.hello1.type"])
+	assert.Equal(t, int64(2), snapshot.Ints["config.units.hello1.processors"])
+	assert.Equal(t, int64(0), snapshot.Ints["config.units.filebeat.inputs.1.processors"])
+	assert.Equal(t,
+		snapshot.Ints["config.units.hello1.bytes"]+snapshot.Ints["config.units.filebeat.inputs.1.bytes"],
+		snapshot.Ints["config.types.filebeat.inputs.bytes"])
+	assert.Equal(t, snapshot.Ints["config.types.output.bytes"], snapshot.Ints["config.units.output.0.bytes"])
+
+	t.Run("only applied blocks are counted", func(t *testing.T) {
+		cm, _, _ := newTestManager(&Config{NoOutput: NoOutputWait})
+		cm.OnConfig(`
+filebeat:
+  inputs:
+    - type: log
+      paths:
+        - /var/log/hello1.log`)
+
+		reg := monitoring.NewRegistry()
+		monitoring.NewFunc(reg, "config", cm.metrics.report, monitoring.Report)
+		snapshot := monitoring.CollectFlatSnapshot(reg, monitoring.Full, false)
+
+		assert.Equal(t, int64(0), snapshot.Ints["config.bytes"])
+		assert.Equal(t, int64(0), snapshot.Ints["config.inputs"])
+	})
+}
+
+func TestNoOutput(t *testing.T) {
+	input := `
+filebeat:
+  inputs:
+    - type: log
+      paths:
+        - /var/log/hello1.log`
+
+	t.Run("wait holds the inputs", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{NoOutput: NoOutputWait})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+
+		cm.OnConfig(input + `
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+		assert.Len(t, inputs.configs, 1)
+	})
+
+	t.Run("local starts the inputs", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{NoOutput: NoOutputLocal})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		local := common.MustNewConfigFrom(map[string]interface{}{
+			"output.elasticsearch.hosts": []string{"localhost:9200"},
+		})
+		assert.NoError(t, cm.CheckRawConfig(local))
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+		assert.Len(t, inputs.configs, 1)
+	})
+
+	t.Run("local waits without a local output", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{NoOutput: NoOutputLocal})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+		assert.NoError(t, cm.CheckRawConfig(common.NewConfig()))
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+	})
+
+	t.Run("local waits once Agent unset the output", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{NoOutput: NoOutputLocal})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input + `
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+		// an output-less config with no inputs unsets the output
+		cm.OnConfig("")
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+	})
+
+	t.Run("invalid reports failed", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{NoOutput: NoOutputInvalid})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+	})
+}
+
+func TestReloadBarrier(t *testing.T) {
+	input := `
+filebeat:
+  inputs:
+    - type: log
+      paths:
+        - /var/log/hello1.log
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`
+
+	t.Run("applies once the barrier is released", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+		barrier := &mockBarrier{}
+		cm.SetReloadBarrier(barrier)
+
+		cm.OnConfig(input)
+		assert.Equal(t, 1, barrier.calls)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+		assert.Len(t, inputs.configs, 1)
+	})
+
+	t.Run("does not apply when the barrier fails", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+		barrier := &mockBarrier{err: errors.New("peers not ready")}
+		cm.SetReloadBarrier(barrier)
+
+		cm.OnConfig(input)
+		assert.Equal(t, 1, barrier.calls)
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+	})
+
+	t.Run("does not apply when the barrier times out", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{ReloadBarrierTimeout: 10 * time.Millisecond})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+		barrier := &mockBarrier{block: true}
+		cm.SetReloadBarrier(barrier)
+
+		cm.OnConfig(input)
+		assert.Equal(t, 1, barrier.calls)
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+		assert.Empty(t, inputs.configs)
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	input := `
+filebeat:
+  inputs:
+    - type: log
+      id: hello1
+      paths:
+        - /var/log/hello1.log
+    - type: log
+      id: hello2
+      paths:
+        - /var/log/hello2.log
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`
+
+	t.Run("reports degraded while units don't match", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+		// the reloadable silently drops a unit change
+		inputs.drop = 1
+		cm.OnConfig(strings.Replace(input, "hello2.log", "hello3.log", 1))
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, "Running units don't match the units expected by Agent: filebeat.inputs (1 missing, 0 unexpected)", c.lastMessage())
+		mismatch := c.lastPayload()["units_mismatch"].(map[string]unitMismatch)
+		assert.Equal(t, []string{"hello2"}, mismatch["filebeat.inputs"].Missing)
+
+		inputs.drop = 0
+		inputs.Reload(inputs.configs[:0])
+		cm.reconcile()
+		mismatch = c.lastPayload()["units_mismatch"].(map[string]unitMismatch)
+		assert.Equal(t, []string{"hello1", "hello2"}, mismatch["filebeat.inputs"].Missing)
+
+		cm.OnConfig(input)
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("reports unexpected units", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		inputs.Reload(append(inputs.configs,
+			&reload.ConfigWithMeta{
+				Config: common.MustNewConfigFrom(map[string]interface{}{"type": "stdin"}),
+			},
+			&reload.ConfigWithMeta{
+				Config: common.MustNewConfigFrom(map[string]interface{}{"type": "log", "id": "stale"}),
+			},
+		))
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		mismatch := c.lastPayload()["units_mismatch"].(map[string]unitMismatch)
+		assert.Equal(t, []string{"stale", "stdin"}, mismatch["filebeat.inputs"].Unexpected)
+	})
+
+	t.Run("drops the result when a config is applied meanwhile", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		inputs.Reload(nil)
+		inputs.onConfigs = func() {
+			inputs.onConfigs = nil
+			cm.OnConfig(input)
+		}
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("skipped once a stop is requested", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+		cm.stopFunc = func() {}
+
+		cm.OnConfig(input)
+		inputs.Reload(nil)
+		cm.OnStop()
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_STOPPING, c.lastStatus())
+	})
+
+	t.Run("checked every period", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		cm.scheduleReconcile(time.Minute)
+		inputs.Reload(nil)
+		clock.Sleep(time.Minute)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, 1, clock.pending())
+
+		cm.cancel()
+		clock.Sleep(time.Minute)
+		assert.Equal(t, 0, clock.pending())
+	})
+
+	t.Run("does not override a failed status", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		inputs.Reload(nil)
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+
+		cm.UpdateStatus(management.Failed, "output failed")
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_FAILED, c.lastStatus())
+	})
+}
+
+func TestMissingPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet-missing-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "*.log")
+	input := fmt.Sprintf(`
+filebeat:
+  inputs:
+    - type: log
+      id: hello
+      paths:
+        - %s
+output:
+  elasticsearch:
+    hosts:
+      - localhost:9200`, path)
+
+	t.Run("ignore doesn't check the paths", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{MissingPaths: MissingPathsIgnore})
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("recursive patterns are not checked", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{MissingPaths: MissingPathsDegraded})
+
+		cm.OnConfig(strings.Replace(input, path, filepath.Join(dir, "**", "*.log"), 1))
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("degraded until the paths exist", func(t *testing.T) {
+		cm, c, _ := newTestManager(&Config{MissingPaths: MissingPathsDegraded})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, map[string][]string{"hello": {path}}, c.lastPayload()["missing_paths"])
+		assert.Len(t, inputs.configs, 1)
+
+		cm.recheckMissingPaths()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello.log"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cm.recheckMissingPaths()
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("reported with units mismatch", func(t *testing.T) {
+		os.Remove(filepath.Join(dir, "hello.log"))
+		cm, c, _ := newTestManager(&Config{MissingPaths: MissingPathsDegraded})
+		inputs := cm.registry.GetReloadableList("filebeat.inputs").(*dummyReloadableList)
+
+		cm.OnConfig(input)
+		inputs.Reload(nil)
+		cm.reconcile()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, "Inputs waiting on missing paths: hello; Running units don't match the units expected by Agent: filebeat.inputs (1 missing, 0 unexpected)", c.lastMessage())
+		assert.Contains(t, c.lastPayload(), "missing_paths")
+		assert.Contains(t, c.lastPayload(), "units_mismatch")
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello.log"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cm.recheckMissingPaths()
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+		assert.Equal(t, "Running units don't match the units expected by Agent: filebeat.inputs (1 missing, 0 unexpected)", c.lastMessage())
+		assert.NotContains(t, c.lastPayload(), "missing_paths")
+
+		inputs.Reload([]*reload.ConfigWithMeta{})
+		cm.OnConfig(input)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+	})
+
+	t.Run("checked every period", func(t *testing.T) {
+		cm, c, clock := newTestManager(&Config{MissingPaths: MissingPathsDegraded})
+		cm.OnConfig(strings.Replace(input, path, filepath.Join(dir, "*.txt"), 1))
+		assert.Equal(t, proto.StateObserved_DEGRADED, c.lastStatus())
+
+		cm.scheduleMissingPaths(time.Minute)
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		clock.Sleep(time.Minute)
+		assert.Equal(t, proto.StateObserved_HEALTHY, c.lastStatus())
+		assert.Equal(t, 1, clock.pending())
+
+		cm.cancel()
+		clock.Sleep(time.Minute)
+		assert.Equal(t, 0, clock.pending())
+	})
+
+	t.Run("not checked once a stop is requested", func(t *testing.T) {
+		os.Remove(filepath.Join(dir, "hello.log"))
+		cm, c, _ := newTestManager(&Config{MissingPaths: MissingPathsDegraded})
+		cm.stopFunc = func() {}
+
+		cm.OnConfig(input)
+		cm.OnStop()
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello.log"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cm.recheckMissingPaths()
+		assert.Equal(t, proto.StateObserved_STOPPING, c.lastStatus())
+	})
+}
+
+func TestManagerConfig(t *testing.T) {
+	config := defaultConfig()
+	config.FlapSuppression = time.Minute
+	cm, _, _ := newTestManager(config)
+
+	c := cm.Config()
+	assert.Equal(t, *config, c)
+
+	c.Blacklist.Patterns["output"] = "elasticsearch"
+	assert.Equal(t, "console|file", cm.Config().Blacklist.Patterns["output"])
+}
+
+func TestShutdown(t *testing.T) {
+	config := func() *Config {
+		return &Config{Enabled: true, Mode: xmanagement.ModeFleet, ShutdownTimeout: time.Minute}
+	}
+
+	t.Run("graceful", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+		cm.stopFunc = func() {}
+
+		cm.OnStop()
+		clock.Sleep(30 * time.Second)
+		stopManager(t, cm, clock)
+		assert.Equal(t, proto.StateObserved_STOPPING, c.lastStatus())
+		assert.Equal(t, "Stopped", c.lastMessage())
+		assert.Equal(t, map[string]interface{}{"graceful": true}, c.lastPayload()["shutdown"])
+	})
+
+	t.Run("final state is sent before stopping the client", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+		cm.stopFunc = func() {}
+		cm.OnStop()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cm.Stop()
+		}()
+
+		waitFor(t, func() bool { return c.lastMessage() == "Stopped" })
+		time.Sleep(10 * time.Millisecond)
+		assert.False(t, c.isStopped())
+
+		clock.Sleep(finalStatusDelay)
+		<-done
+		assert.True(t, c.isStopped())
+		assert.Equal(t, []string{"Stopping", "Stopped", "stop"}, c.events())
+	})
+
+	t.Run("timeout exceeded while stopping", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+		cm.stopFunc = func() {}
+
+		cm.OnStop()
+		clock.Sleep(2 * time.Minute)
+		assert.Equal(t, proto.StateObserved_STOPPING, c.lastStatus())
+		assert.Equal(t, "Stopping ungracefully: shutdown timeout of 1m0s exceeded", c.lastMessage())
+		shutdown := c.lastPayload()["shutdown"].(map[string]interface{})
+		assert.Equal(t, false, shutdown["graceful"])
+
+		stopManager(t, cm, clock)
+		assert.Equal(t, "Stopped ungracefully: shutdown timeout of 1m0s exceeded", c.lastMessage())
+	})
+
+	t.Run("stop not requested by Agent", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+
+		stopManager(t, cm, clock)
+		assert.Equal(t, "Stopped", c.lastMessage())
+		assert.Equal(t, map[string]interface{}{"graceful": true}, c.lastPayload()["shutdown"])
+	})
+
+	t.Run("status is stopping once requested", func(t *testing.T) {
+		cm, c, _ := newTestManager(config())
+		cm.stopFunc = func() {}
+
+		cm.OnStop()
+		cm.UpdateStatus(management.Stopping, "Stopping")
+		assert.Equal(t, []string{"Stopping"}, c.events())
+	})
+
+	t.Run("panic during shutdown", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+		cm.stopFunc = func() { panic("boom") }
+
+		recovered := make(chan interface{})
+		go func() {
+			defer func() { recovered <- recover() }()
+			cm.OnStop()
+		}()
+
+		waitFor(t, func() bool { return c.lastMessage() == "Stopping ungracefully: panic during shutdown: boom" })
+		shutdown := c.lastPayload()["shutdown"].(map[string]interface{})
+		assert.Equal(t, false, shutdown["graceful"])
+
+		clock.Sleep(finalStatusDelay)
+		assert.Equal(t, "boom", <-recovered)
+	})
+
+	t.Run("does not wait for a client never started", func(t *testing.T) {
+		cm, c, _ := newTestManager(config())
+		cm.started = false
+
+		cm.Stop()
+		assert.Equal(t, "Stopped", c.lastMessage())
+		assert.True(t, c.isStopped())
+	})
+
+	t.Run("panic stopping the beat", func(t *testing.T) {
+		cm, c, clock := newTestManager(config())
+		cm.stopFunc = func() {}
+		cm.OnStop()
+
+		recovered := make(chan interface{})
+		go func() {
+			defer func() { recovered <- recover() }()
+			defer cm.Stop()
+			panic("boom")
+		}()
+
+		waitFor(t, func() bool { return c.lastMessage() == "Stopped ungracefully: panic: boom" })
+		clock.Sleep(finalStatusDelay)
+		assert.Equal(t, "boom", <-recovered)
+		assert.True(t, c.isStopped())
+	})
+}
+
+// stopManager stops the manager, advancing the clock until the final status
+// is flushed.
+func stopManager(t *testing.T, cm *Manager, clock *testClock) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cm.Stop()
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			clock.Sleep(finalStatusDelay)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
+
+func newTestManager(config *Config) (*Manager, *mockClient, *testClock) {
+	reg := reload.NewRegistry()
+	reg.MustRegister("output", &dummyReloadable{})
+	reg.MustRegisterList("filebeat.inputs", &dummyReloadableList{})
+
+	blacklist, _ := xmanagement.NewConfigBlacklist(xmanagement.ConfigBlacklistSettings{})
+
+	c := &mockClient{}
+	clock := &testClock{now: time.Now()}
+	cm := &Manager{
+		config:    config,
+		logger:    logp.NewLogger("fleet"),
+		registry:  reg,
+		blacklist: blacklist,
+		client:    c,
+		metrics:   &configMetrics{},
+		clock:     clock,
+		started:   true,
+	}
+	cm.ctx, cm.cancel = context.WithCancel(context.Background())
+	return cm, c, clock
+}
+
+type testClock struct {
+	sync.Mutex
+
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	clock *testClock
+	at    time.Time
+	f     func()
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) AfterFunc(d time.Duration, f func()) timer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &testTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Sleep advances the clock and runs the timers that expired.
+func (c *testClock) Sleep(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	var expired, pending []*testTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			expired = append(expired, t)
+		}
+	}
+	c.timers = pending
+	c.Unlock()
+
+	for _, t := range expired {
+		t.f()
+	}
+}
+
+func (c *testClock) pending() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.timers)
+}
+
+func (t *testTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type mockClient struct {
+	sync.Mutex
+
+	statuses []proto.StateObserved_Status
+	messages []string
+	payloads []map[string]interface{}
+	stopped  bool
+}
+
+func (c *mockClient) Start(ctx context.Context) error { return nil }
+
+func (c *mockClient) Stop() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.stopped = true
+}
+
+func (c *mockClient) RegisterAction(action client.Action)   {}
+func (c *mockClient) UnregisterAction(action client.Action) {}
+
+func (c *mockClient) Status(status proto.StateObserved_Status, message string, payload map[string]interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.statuses = append(c.statuses, status)
+	c.messages = append(c.messages, message)
+	c.payloads = append(c.payloads, payload)
+	return nil
+}
+
+func (c *mockClient) lastStatus() proto.StateObserved_Status {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.statuses) == 0 {
+		return proto.StateObserved_STARTING
+	}
+	return c.statuses[len(c.statuses)-1]
+}
+
+func (c *mockClient) lastMessage() string {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.messages) == 0 {
+		return ""
+	}
+	return c.messages[len(c.messages)-1]
+}
+
+func (c *mockClient) isStopped() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.stopped
+}
+
+// events returns the reported messages followed by "stop" once stopped.
+func (c *mockClient) events() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	events := append([]string{}, c.messages...)
+	if c.stopped {
+		events = append(events, "stop")
+	}
+	return events
+}
+
+func (c *mockClient) lastPayload() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.payloads) == 0 {
+		return nil
+	}
+	return c.payloads[len(c.payloads)-1]
+}
+
+// mockBarrier returns err, or blocks until its context is done when block is
+// set.
+type mockBarrier struct {
+	calls int
+	err   error
+	block bool
+}
+
+func (b *mockBarrier) Wait(ctx context.Context) error {
+	b.calls++
+	if b.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.err
+}
+
 type dummyReloadable struct{}
 
 func (dummyReloadable) Reload(config *reload.ConfigWithMeta) error {
 	return nil
 }
+
+// dummyReloadableList records the configs it runs, silently dropping the last
+// drop configs on reload. onConfigs is called once the running configs are
+// listed.
+type dummyReloadableList struct {
+	configs   []*reload.ConfigWithMeta
+	drop      int
+	onConfigs func()
+}
+
+func (r *dummyReloadableList) Reload(configs []*reload.ConfigWithMeta) error {
+	if r.drop > 0 && len(configs) >= r.drop {
+		configs = configs[:len(configs)-r.drop]
+	}
+	r.configs = configs
+	return nil
+}
+
+func (r *dummyReloadableList) Configs() map[uint64]*common.Config {
+	configs := map[uint64]*common.Config{}
+	for _, config := range r.configs {
+		hash, err := cfgfile.HashConfig(config.Config)
+		if err == nil {
+			configs[hash] = config.Config
+		}
+	}
+	if r.onConfigs != nil {
+		r.onConfigs()
+	}
+	return configs
+}
@@ -0,0 +1,144 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/common/reload"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/x-pack/libbeat/management/api"
+)
+
+// configMetricsName is the name of the applied config metrics in the default
+// registry.
+const configMetricsName = "libbeat.management.config"
+
+// configMetrics holds the size and complexity of the last successfully
+// applied configuration.
+type configMetrics struct {
+	mu    sync.Mutex
+	types []string
+	units []unitMetrics
+}
+
+// unitMetrics holds the size and complexity of the configuration applied to
+// a single unit.
+type unitMetrics struct {
+	name       string
+	typ        string
+	input      bool
+	bytes      int64
+	processors int64
+}
+
+// register reports the metrics in the default registry, replacing the ones
+// of a previous manager.
+func (m *configMetrics) register() {
+	if monitoring.Default.Get(configMetricsName) != nil {
+		monitoring.Default.Remove(configMetricsName)
+	}
+	monitoring.NewFunc(nil, configMetricsName, m.report, monitoring.Report)
+}
+
+// update replaces the metrics with the ones computed from the applied blocks.
+// Types registered in the registry without any block are reported as empty.
+func (m *configMetrics) update(blocks api.ConfigBlocks, registry *reload.Registry) {
+	types := registry.GetRegisteredNames()
+	sort.Strings(types)
+
+	var units []unitMetrics
+	for _, b := range blocks {
+		isList := registry.GetReloadableList(b.Type) != nil
+		for i, block := range b.Blocks {
+			units = append(units, newUnitMetrics(b.Type, i, block, isList))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.types = types
+	m.units = units
+}
+
+func newUnitMetrics(t string, i int, block *api.ConfigBlock, isList bool) unitMetrics {
+	u := unitMetrics{name: unitName(t, i, block), typ: t, input: isList}
+	if data, err := json.Marshal(block.Raw); err == nil {
+		u.bytes = int64(len(data))
+	}
+	if processors, ok := block.Raw["processors"].([]interface{}); ok {
+		u.processors = int64(len(processors))
+	}
+	return u
+}
+
+func (m *configMetrics) report(_ monitoring.Mode, V monitoring.Visitor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	var total unitTotals
+	types := map[string]*unitTotals{}
+	for _, t := range m.types {
+		types[t] = &unitTotals{}
+	}
+	for _, u := range m.units {
+		total.add(u)
+		if _, ok := types[u.typ]; !ok {
+			types[u.typ] = &unitTotals{}
+		}
+		types[u.typ].add(u)
+	}
+
+	names := make([]string, 0, len(types))
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+
+	total.report(V)
+	monitoring.ReportNamespace(V, "types", func() {
+		for _, t := range names {
+			monitoring.ReportNamespace(V, t, func() {
+				types[t].report(V)
+			})
+		}
+	})
+	monitoring.ReportNamespace(V, "units", func() {
+		for _, u := range m.units {
+			u := u
+			monitoring.ReportNamespace(V, u.name, func() {
+				monitoring.ReportString(V, "type", u.typ)
+				monitoring.ReportInt(V, "bytes", u.bytes)
+				monitoring.ReportInt(V, "processors", u.processors)
+			})
+		}
+	})
+}
+
+// unitTotals aggregates the metrics of several units.
+type unitTotals struct {
+	bytes      int64
+	inputs     int64
+	processors int64
+}
+
+func (t *unitTotals) add(u unitMetrics) {
+	t.bytes += u.bytes
+	t.processors += u.processors
+	if u.input {
+		t.inputs++
+	}
+}
+
+func (t *unitTotals) report(V monitoring.Visitor) {
+	monitoring.ReportInt(V, "bytes", t.bytes)
+	monitoring.ReportInt(V, "inputs", t.inputs)
+	monitoring.ReportInt(V, "processors", t.processors)
+}
@@ -0,0 +1,91 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/x-pack/libbeat/management/api"
+)
+
+// missingPathsMessage lists the inputs waiting on missing paths.
+func missingPathsMessage(missing map[string][]string) string {
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("Inputs waiting on missing paths: %s", strings.Join(names, ", "))
+}
+
+// scheduleMissingPaths checks the missing paths every period until the
+// manager is stopped.
+func (cm *Manager) scheduleMissingPaths(period time.Duration) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.ctx.Err() != nil {
+		return
+	}
+	cm.missingPathsTimer = cm.clock.AfterFunc(period, func() {
+		cm.recheckMissingPaths()
+		cm.scheduleMissingPaths(period)
+	})
+}
+
+// recheckMissingPaths checks again the paths the inputs are waiting on, the
+// beat is reported as running again once they exist.
+func (cm *Manager) recheckMissingPaths() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if !cm.stopRequested.IsZero() || len(cm.missingPaths) == 0 {
+		return
+	}
+
+	missing := findMissingPaths(cm.inputs)
+	if len(missing) == 0 {
+		cm.logger.Info("All paths referenced by the inputs exist")
+		missing = nil
+	}
+	cm.missingPaths = missing
+	cm.reportDegraded()
+}
+
+// findMissingPaths returns the paths that don't match any file, indexed by the
+// input referencing them. Recursive patterns using ** are expanded by the
+// inputs and are not checked.
+func findMissingPaths(blocks api.ConfigBlocks) map[string][]string {
+	missing := map[string][]string{}
+	for _, b := range blocks {
+		if b.Type == outputType {
+			continue
+		}
+
+		for i, block := range b.Blocks {
+			paths, ok := block.Raw["paths"].([]interface{})
+			if !ok {
+				continue
+			}
+
+			name := unitName(b.Type, i, block)
+
+			for _, p := range paths {
+				path, ok := p.(string)
+				if !ok || strings.Contains(path, "**") {
+					continue
+				}
+				if matches, err := filepath.Glob(path); err == nil && len(matches) == 0 {
+					missing[name] = append(missing[name], path)
+				}
+			}
+		}
+	}
+	return missing
+}
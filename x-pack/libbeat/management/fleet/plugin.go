@@ -20,6 +20,11 @@ func NewFleetManagerPlugin(config *common.Config) management.FactoryFunc {
 	c := defaultConfig()
 	if config.Enabled() {
 		if err := config.Unpack(&c); err != nil {
+			// Invalid fleet settings must not silently disable fleet management,
+			// the factory reports the error when creating the manager.
+			if isFleetMode(config) {
+				return NewFleetManager
+			}
 			return nil
 		}
 
@@ -30,3 +35,10 @@ func NewFleetManagerPlugin(config *common.Config) management.FactoryFunc {
 
 	return nil
 }
+
+func isFleetMode(config *common.Config) bool {
+	var mode struct {
+		Mode string `config:"mode"`
+	}
+	return config.Unpack(&mode) == nil && mode.Mode == xmanagement.ModeFleet
+}
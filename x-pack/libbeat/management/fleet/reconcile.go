@@ -0,0 +1,189 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/cfgfile"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/management"
+	"github.com/elastic/beats/v7/x-pack/libbeat/management/api"
+)
+
+// runningLister is implemented by reloadable lists able to report the configs
+// they are running, like cfgfile.RunnerList.
+type runningLister interface {
+	// Configs returns the running configs, indexed by hash.
+	Configs() map[uint64]*common.Config
+}
+
+// unitMismatch describes the difference between the units expected by Agent
+// and the units running in the beat for a config type.
+type unitMismatch struct {
+	Missing    []string `json:"missing,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+}
+
+// setExpected records the units expected to run, indexed by config type and
+// config hash, for the config types that can report their running configs.
+func (cm *Manager) setExpected(blocks api.ConfigBlocks) {
+	expected := map[string]map[uint64]string{}
+	for _, name := range cm.registry.GetRegisteredNames() {
+		if _, ok := cm.registry.GetReloadableList(name).(runningLister); ok {
+			expected[name] = map[uint64]string{}
+		}
+	}
+	for _, b := range blocks {
+		units, ok := expected[b.Type]
+		if !ok {
+			continue
+		}
+		for i, block := range b.Blocks {
+			config, err := block.Config()
+			if err != nil {
+				continue
+			}
+			hash, err := cfgfile.HashConfig(config)
+			if err != nil {
+				continue
+			}
+			units[hash] = unitName(b.Type, i, block)
+		}
+	}
+
+	cm.lock.Lock()
+	cm.expected = expected
+	cm.generation++
+	cm.lock.Unlock()
+}
+
+// scheduleReconcile reconciles the units every period until the manager is
+// stopped.
+func (cm *Manager) scheduleReconcile(period time.Duration) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.ctx.Err() != nil {
+		return
+	}
+	cm.reconcileTimer = cm.clock.AfterFunc(period, func() {
+		cm.reconcile()
+		cm.scheduleReconcile(period)
+	})
+}
+
+// reconcile compares the units running in the beat with the units expected by
+// Agent. A running beat is reported as degraded while they don't match, and
+// as running again once they do.
+func (cm *Manager) reconcile() {
+	cm.lock.Lock()
+	if !cm.stopRequested.IsZero() {
+		cm.lock.Unlock()
+		return
+	}
+	expected, generation := cm.expected, cm.generation
+	cm.lock.Unlock()
+
+	// query the reloadables without holding the lock, they can be busy reloading
+	delta := map[string]unitMismatch{}
+	for t, units := range expected {
+		lister, ok := cm.registry.GetReloadableList(t).(runningLister)
+		if !ok {
+			continue
+		}
+		if d := diffUnits(units, lister.Configs()); len(d.Missing) > 0 || len(d.Unexpected) > 0 {
+			delta[t] = d
+		}
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.generation != generation || !cm.stopRequested.IsZero() {
+		// a new configuration was applied or a stop was requested meanwhile,
+		// the delta is outdated
+		return
+	}
+
+	if cm.status != management.Running && len(cm.missingPaths) == 0 && len(cm.mismatch) == 0 {
+		// already reporting a non healthy status
+		return
+	}
+
+	if len(delta) == 0 {
+		if len(cm.mismatch) == 0 {
+			return
+		}
+		cm.logger.Info("Running units match the units expected by Agent")
+		delta = nil
+	}
+	cm.mismatch = delta
+	cm.reportDegraded()
+}
+
+// mismatchMessage summarizes the difference between the expected and the
+// running units.
+func mismatchMessage(delta map[string]unitMismatch) string {
+	types := make([]string, 0, len(delta))
+	for t := range delta {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	details := make([]string, 0, len(types))
+	for _, t := range types {
+		details = append(details, fmt.Sprintf("%s (%d missing, %d unexpected)", t, len(delta[t].Missing), len(delta[t].Unexpected)))
+	}
+	return fmt.Sprintf("Running units don't match the units expected by Agent: %s", strings.Join(details, ", "))
+}
+
+// diffUnits returns the expected units that are not running and the running
+// units that are not expected.
+func diffUnits(expected map[uint64]string, running map[uint64]*common.Config) unitMismatch {
+	var d unitMismatch
+	for hash, config := range running {
+		if _, ok := expected[hash]; !ok {
+			d.Unexpected = append(d.Unexpected, runningName(hash, config))
+		}
+	}
+	for hash, name := range expected {
+		if _, ok := running[hash]; !ok {
+			d.Missing = append(d.Missing, name)
+		}
+	}
+	sort.Strings(d.Missing)
+	sort.Strings(d.Unexpected)
+	return d
+}
+
+// unitName returns the name used to report a unit, its id when set.
+func unitName(t string, i int, block *api.ConfigBlock) string {
+	if id, ok := block.Raw["id"].(string); ok && id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s.%d", t, i)
+}
+
+// runningName returns the name used to report a running unit, its id or its
+// type when set.
+func runningName(hash uint64, config *common.Config) string {
+	var unit struct {
+		ID   string `config:"id"`
+		Type string `config:"type"`
+	}
+	if config != nil && config.Unpack(&unit) == nil {
+		if unit.ID != "" {
+			return unit.ID
+		}
+		if unit.Type != "" {
+			return unit.Type
+		}
+	}
+	return fmt.Sprintf("%d", hash)
+}